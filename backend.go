@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backendRandomTTL is the replay window nextcloud-spreed-signaling-style
+// backend calls are checked against: a Spreed-Signaling-Random value seen
+// again within this window is rejected as a replay.
+const backendRandomTTL = 5 * time.Minute
+
+var backendRandomMu sync.Mutex
+var backendSeenRandoms = make(map[string]time.Time)
+
+// checkBackendReplay records random as seen and reports whether it is fresh
+// (i.e. not seen within the last backendRandomTTL). Expired entries are
+// swept out on each call, keeping the map bounded to recent traffic.
+func checkBackendReplay(random string) bool {
+	now := time.Now()
+
+	backendRandomMu.Lock()
+	defer backendRandomMu.Unlock()
+
+	for r, seenAt := range backendSeenRandoms {
+		if now.Sub(seenAt) > backendRandomTTL {
+			delete(backendSeenRandoms, r)
+		}
+	}
+
+	if seenAt, ok := backendSeenRandoms[random]; ok && now.Sub(seenAt) <= backendRandomTTL {
+		return false
+	}
+
+	backendSeenRandoms[random] = now
+	return true
+}
+
+// backendAuth authenticates a backend integration request the way
+// nextcloud-spreed-signaling authenticates its backend callbacks: the
+// request carries Spreed-Signaling-Random and Spreed-Signaling-Checksum
+// headers, where checksum = hex(HMAC_SHA256(secret, random || body)).
+func backendAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(backendSecret) == 0 {
+			http.Error(w, "Backend integration is not configured", http.StatusServiceUnavailable)
+			return
+		}
+
+		random := r.Header.Get("Spreed-Signaling-Random")
+		checksum := r.Header.Get("Spreed-Signaling-Checksum")
+		if len(random) < 32 || checksum == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		if !checkBackendReplay(random) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		mac := hmac.New(sha256.New, backendSecret)
+		mac.Write([]byte(random))
+		mac.Write(body)
+		expected := mac.Sum(nil)
+
+		got, err := hex.DecodeString(checksum)
+		if err != nil || !hmac.Equal(expected, got) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+type createRoomRequest struct {
+	RoomID         string            `json:"room_id"`
+	MaxClients     int               `json:"max_clients"`
+	TTLSeconds     int               `json:"ttl_seconds"`
+	AllowedOrigins []string          `json:"allowed_origins"`
+	PlayerURL      string            `json:"player_url"`
+	JoinTokens     map[string]string `json:"join_tokens"`
+}
+
+type createRoomResponse struct {
+	RoomID string `json:"room_id"`
+}
+
+// handleBackendCreateRoom implements POST /api/backend/rooms, letting an
+// authenticated backend provision a room in advance with its constraints
+// and an optional preloaded video.
+func handleBackendCreateRoom(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req createRoomRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	roomID := req.RoomID
+	if roomID == "" {
+		roomID = generateID()
+	}
+
+	opts := &BackendOptions{
+		MaxClients:     req.MaxClients,
+		AllowedOrigins: req.AllowedOrigins,
+	}
+	if req.TTLSeconds > 0 {
+		opts.ExpiresAt = time.Now().Add(time.Duration(req.TTLSeconds) * time.Second)
+	}
+	if len(req.JoinTokens) > 0 {
+		opts.JoinTokens = req.JoinTokens
+	}
+
+	roomsMutex.Lock()
+	room, exists := rooms[roomID]
+	if !exists {
+		history := roomStore.Load(roomID, historyLimit)
+		room = &Room{
+			ID:             roomID,
+			Clients:        make(map[*Client]bool),
+			BulletLimiters: make(map[string]*bulletLimiter),
+			History:        history,
+		}
+		if len(history) > 0 {
+			room.nextMessageID = history[len(history)-1].ID
+		}
+		rooms[roomID] = room
+	}
+	roomsMutex.Unlock()
+
+	room.Mutex.Lock()
+	room.Backend = opts
+	if req.PlayerURL != "" {
+		room.Player = &PlayerState{
+			URL:           req.PlayerURL,
+			PlaybackRate:  1,
+			IsPaused:      true,
+			LastUpdatedBy: "backend",
+			LastUpdatedAt: time.Now(),
+		}
+	}
+	room.Mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(createRoomResponse{RoomID: roomID}); err != nil {
+		log.Printf("Error encoding create-room response: %v", err)
+	}
+}
+
+type backendMessageRequest struct {
+	Text string `json:"text"`
+}
+
+// handleBackendRoomMessage implements POST /api/backend/rooms/{id}/message,
+// letting an authenticated backend inject a server-authored system message
+// into an existing room.
+func handleBackendRoomMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rest := strings.TrimPrefix(r.URL.Path, "/api/backend/rooms/")
+	roomID, ok := strings.CutSuffix(rest, "/message")
+	if !ok || roomID == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	roomsMutex.Lock()
+	room, exists := rooms[roomID]
+	roomsMutex.Unlock()
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+
+	var req backendMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Text) == "" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	broadcastEnvelope(room, "system", chatPayload{Text: req.Text}, "", "backend")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// backendOptionsAllow reports whether a client may join room under the
+// constraints provisioned via the backend API. Called after JWT parsing but
+// before the client is added to room.Clients.
+func backendOptionsAllow(room *Room, opts *BackendOptions, userID, origin string) bool {
+	if !opts.ExpiresAt.IsZero() && time.Now().After(opts.ExpiresAt) {
+		return false
+	}
+
+	if len(opts.JoinTokens) > 0 && !joinTokenGrants(opts.JoinTokens, userID) {
+		return false
+	}
+
+	if len(opts.AllowedOrigins) > 0 {
+		allowed := false
+		for _, o := range opts.AllowedOrigins {
+			if o == origin {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+
+	if opts.MaxClients > 0 {
+		room.Mutex.Lock()
+		full := len(room.Clients) >= opts.MaxClients
+		room.Mutex.Unlock()
+		if full {
+			return false
+		}
+	}
+
+	return true
+}
+
+// joinTokenGrants reports whether userID is the value redeemed for some
+// token in tokens.
+func joinTokenGrants(tokens map[string]string, userID string) bool {
+	for _, id := range tokens {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
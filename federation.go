@@ -0,0 +1,502 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// instanceID identifies this process in federated envelopes, so a message
+// that loops back to its origin instance can be recognized and dropped.
+var instanceID = generateID()
+
+// proxySecret authenticates the federation "hello" handshake between
+// instances (see performClientHandshake/performServerHandshake). Federation
+// is disabled unless this is configured; dialing out to peers additionally
+// needs at least one peer address.
+var proxySecret []byte
+
+const federationDialRetryInterval = 5 * time.Second
+
+// proxyEnvelope is the small protocol spoken over a federation connection,
+// modeled on nextcloud-spreed-signaling's proxy server messages.
+type proxyEnvelope struct {
+	Type    string          `json:"type"`
+	RoomID  string          `json:"roomId,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Origin  string          `json:"origin,omitempty"`
+}
+
+type helloPayload struct {
+	Nonce    string `json:"nonce"`
+	Checksum string `json:"checksum"`
+}
+
+// federatedMessage is the payload carried by a "message" or "player"
+// proxyEnvelope, letting the receiving instance replay it to its own local
+// clients and history.
+type federatedMessage struct {
+	MsgType           string          `json:"msgType"`
+	Payload           json.RawMessage `json:"payload"`
+	AuthorUserID      string          `json:"authorUserId"`
+	AuthorDisplayName string          `json:"authorDisplayName"`
+}
+
+func computeHelloChecksum(nonce string) string {
+	mac := hmac.New(sha256.New, proxySecret)
+	mac.Write([]byte(nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// federationPeer is one persistent, authenticated connection to another
+// cheetah.ninja instance, in either the dialer or acceptor role.
+type federationPeer struct {
+	addr string
+	conn *websocket.Conn
+
+	// outbox is this peer's outbound buffered channel, mirroring
+	// Client.Send: writePump is the only goroutine that writes to conn, so a
+	// stalled peer can never block a room's broadcastLocked/forwardToPeers
+	// call, which runs with room.Mutex held.
+	outbox chan []byte
+
+	mu              sync.Mutex
+	interestedRooms map[string]bool
+}
+
+func newFederationPeer(addr string, conn *websocket.Conn) *federationPeer {
+	return &federationPeer{
+		addr:            addr,
+		conn:            conn,
+		outbox:          make(chan []byte, sendBufferSize),
+		interestedRooms: make(map[string]bool),
+	}
+}
+
+// send queues data for writePump, dropping it if the peer is backed up
+// rather than blocking the caller.
+func (p *federationPeer) send(data []byte) {
+	select {
+	case p.outbox <- data:
+	default:
+		log.Printf("Federation: dropping message to slow peer %s: outbox full", p.addr)
+	}
+}
+
+// writePump is the only goroutine writing to p.conn. It drains outbox until
+// closed, then tears the connection down.
+func (p *federationPeer) writePump() {
+	defer p.conn.Close()
+	for msg := range p.outbox {
+		p.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := p.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+			log.Printf("Federation: error writing to peer %s: %v", p.addr, err)
+			return
+		}
+	}
+}
+
+// closeWithBye queues a "bye" envelope and closes outbox so writePump sends
+// it and tears the connection down right after, matching
+// nextcloud-spreed-signaling's CloseAfterSend pattern.
+func (p *federationPeer) closeWithBye() {
+	env := proxyEnvelope{Type: "bye", Origin: instanceID}
+	if data, err := json.Marshal(env); err == nil {
+		p.send(data)
+	}
+	close(p.outbox)
+}
+
+// readLoop processes inbound proxy envelopes until the connection breaks or
+// a "bye" is received, then returns so the caller can retry/clean up.
+func (p *federationPeer) readLoop() {
+	for {
+		_, data, err := p.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var env proxyEnvelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			continue
+		}
+
+		switch env.Type {
+		case "join":
+			p.mu.Lock()
+			p.interestedRooms[env.RoomID] = true
+			p.mu.Unlock()
+
+		case "leave":
+			p.mu.Lock()
+			delete(p.interestedRooms, env.RoomID)
+			p.mu.Unlock()
+
+		case "message":
+			applyFederatedMessage(env.RoomID, env.Origin, env.Payload)
+
+		case "player":
+			applyFederatedPlayer(env.RoomID, env.Origin, env.Payload)
+
+		case "bye":
+			return
+		}
+	}
+}
+
+var federationMu sync.Mutex
+var federationPeers []*federationPeer
+
+func registerPeer(p *federationPeer) {
+	federationMu.Lock()
+	federationPeers = append(federationPeers, p)
+	federationMu.Unlock()
+}
+
+func unregisterPeer(p *federationPeer) {
+	federationMu.Lock()
+	for i, peer := range federationPeers {
+		if peer == p {
+			federationPeers = append(federationPeers[:i], federationPeers[i+1:]...)
+			break
+		}
+	}
+	federationMu.Unlock()
+}
+
+func peerSnapshot() []*federationPeer {
+	federationMu.Lock()
+	defer federationMu.Unlock()
+	peers := make([]*federationPeer, len(federationPeers))
+	copy(peers, federationPeers)
+	return peers
+}
+
+// dialPeer maintains a persistent, authenticated connection to addr,
+// reconnecting with a fixed backoff whenever it drops.
+func dialPeer(addr string) {
+	url := addr
+	if !strings.Contains(url, "://") {
+		url = "ws://" + addr
+	}
+	url = strings.TrimSuffix(url, "/") + "/federation/ws"
+
+	for {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			log.Printf("Federation: could not dial peer %s: %v", addr, err)
+			time.Sleep(federationDialRetryInterval)
+			continue
+		}
+
+		peer, err := performClientHandshake(addr, conn)
+		if err != nil {
+			log.Printf("Federation: handshake with peer %s failed: %v", addr, err)
+			conn.Close()
+			time.Sleep(federationDialRetryInterval)
+			continue
+		}
+
+		log.Printf("Federation: connected to peer %s", addr)
+		registerPeer(peer)
+		go peer.writePump()
+		peer.readLoop()
+		unregisterPeer(peer)
+		log.Printf("Federation: lost connection to peer %s, reconnecting", addr)
+		time.Sleep(federationDialRetryInterval)
+	}
+}
+
+func performClientHandshake(addr string, conn *websocket.Conn) (*federationPeer, error) {
+	nonce := generateID()
+	hello := helloPayload{Nonce: nonce, Checksum: computeHelloChecksum(nonce)}
+	helloData, err := json.Marshal(hello)
+	if err != nil {
+		return nil, err
+	}
+	envData, err := json.Marshal(proxyEnvelope{Type: "hello", Payload: helloData, Origin: instanceID})
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, envData); err != nil {
+		return nil, err
+	}
+
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	var reply proxyEnvelope
+	if err := json.Unmarshal(data, &reply); err != nil || reply.Type != "hello" {
+		return nil, fmt.Errorf("expected hello reply from %s", addr)
+	}
+	var replyHello helloPayload
+	if err := json.Unmarshal(reply.Payload, &replyHello); err != nil {
+		return nil, err
+	}
+	if replyHello.Checksum != computeHelloChecksum(replyHello.Nonce) {
+		return nil, fmt.Errorf("invalid handshake checksum from peer %s", addr)
+	}
+
+	return newFederationPeer(addr, conn), nil
+}
+
+// handleFederationInbound accepts a peer connecting to us (the acceptor side
+// of the hello handshake), so a full mesh doesn't require every instance to
+// list every other instance in --proxy-peers.
+func handleFederationInbound(w http.ResponseWriter, r *http.Request) {
+	if len(proxySecret) == 0 {
+		http.Error(w, "Federation is not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Federation: error upgrading inbound peer connection: %v", err)
+		return
+	}
+
+	peer, err := performServerHandshake(r.RemoteAddr, conn)
+	if err != nil {
+		log.Printf("Federation: inbound handshake from %s failed: %v", r.RemoteAddr, err)
+		conn.Close()
+		return
+	}
+
+	log.Printf("Federation: accepted peer %s", r.RemoteAddr)
+	registerPeer(peer)
+	go peer.writePump()
+	peer.readLoop()
+	unregisterPeer(peer)
+}
+
+func performServerHandshake(addr string, conn *websocket.Conn) (*federationPeer, error) {
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	var env proxyEnvelope
+	if err := json.Unmarshal(data, &env); err != nil || env.Type != "hello" {
+		return nil, fmt.Errorf("expected hello, got %q", env.Type)
+	}
+	var hello helloPayload
+	if err := json.Unmarshal(env.Payload, &hello); err != nil {
+		return nil, err
+	}
+	if hello.Checksum != computeHelloChecksum(hello.Nonce) {
+		return nil, fmt.Errorf("invalid handshake checksum from %s", addr)
+	}
+
+	nonce := generateID()
+	reply := helloPayload{Nonce: nonce, Checksum: computeHelloChecksum(nonce)}
+	replyData, err := json.Marshal(reply)
+	if err != nil {
+		return nil, err
+	}
+	replyEnvData, err := json.Marshal(proxyEnvelope{Type: "hello", Payload: replyData, Origin: instanceID})
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, replyEnvData); err != nil {
+		return nil, err
+	}
+
+	return newFederationPeer(addr, conn), nil
+}
+
+// announceRoomInterest tells every peer whether this instance currently has
+// local clients in roomID, so they know whether to forward it traffic.
+// Called only on the first join / last leave for a room, not on every
+// client change.
+func announceRoomInterest(roomID string, interested bool) {
+	msgType := "leave"
+	if interested {
+		msgType = "join"
+	}
+	data, err := json.Marshal(proxyEnvelope{Type: msgType, RoomID: roomID, Origin: instanceID})
+	if err != nil {
+		return
+	}
+	for _, peer := range peerSnapshot() {
+		peer.send(data)
+	}
+}
+
+// forwardToPeers relays a just-broadcast room event to every peer that has
+// advertised interest in roomID. player.sync events use the dedicated
+// "player" envelope type so peers can fold them into their own Room.Player
+// instead of just appending to history.
+func forwardToPeers(roomID, msgType string, payload interface{}, authorUserID, authorDisplayName string) {
+	peers := peerSnapshot()
+	if len(peers) == 0 {
+		return
+	}
+
+	payloadData, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Federation: error marshaling payload: %v", err)
+		return
+	}
+
+	fm := federatedMessage{
+		MsgType:           msgType,
+		Payload:           payloadData,
+		AuthorUserID:      authorUserID,
+		AuthorDisplayName: authorDisplayName,
+	}
+	fmData, err := json.Marshal(fm)
+	if err != nil {
+		log.Printf("Federation: error marshaling federated message: %v", err)
+		return
+	}
+
+	envType := "message"
+	if msgType == "player.sync" {
+		envType = "player"
+	}
+	envData, err := json.Marshal(proxyEnvelope{Type: envType, RoomID: roomID, Payload: fmData, Origin: instanceID})
+	if err != nil {
+		return
+	}
+
+	for _, peer := range peers {
+		peer.mu.Lock()
+		interested := peer.interestedRooms[roomID]
+		peer.mu.Unlock()
+		if interested {
+			peer.send(envData)
+		}
+	}
+}
+
+// decodeFederatedPayload reconstructs the concrete payload type for msgType
+// so it can be re-broadcast to local clients the same way a local event
+// would be.
+func decodeFederatedPayload(msgType string, raw json.RawMessage) (interface{}, bool) {
+	switch msgType {
+	case "chat", "system":
+		var p chatPayload
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return nil, false
+		}
+		return p, true
+	case "bullet":
+		var p bulletPayload
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return nil, false
+		}
+		return p, true
+	default:
+		return nil, false
+	}
+}
+
+// applyFederatedMessage replays a peer-forwarded chat/bullet/system message
+// to this instance's local clients, without forwarding it on again.
+func applyFederatedMessage(roomID, origin string, raw json.RawMessage) {
+	if origin == instanceID {
+		return // looped back to its origin; drop it
+	}
+
+	var fm federatedMessage
+	if err := json.Unmarshal(raw, &fm); err != nil {
+		return
+	}
+	payload, ok := decodeFederatedPayload(fm.MsgType, fm.Payload)
+	if !ok {
+		return
+	}
+
+	roomsMutex.Lock()
+	room, exists := rooms[roomID]
+	roomsMutex.Unlock()
+	if !exists {
+		return
+	}
+
+	room.Mutex.Lock()
+	defer room.Mutex.Unlock()
+	deliverLocalAndRecord(room, fm.MsgType, payload, fm.AuthorUserID, fm.AuthorDisplayName)
+}
+
+// applyFederatedPlayer folds a peer's player.sync snapshot into this
+// instance's local PlayerState and relays the reconciled state to local
+// clients, without forwarding it on again.
+func applyFederatedPlayer(roomID, origin string, raw json.RawMessage) {
+	if origin == instanceID {
+		return
+	}
+
+	var fm federatedMessage
+	if err := json.Unmarshal(raw, &fm); err != nil {
+		return
+	}
+	var snap playerSyncPayload
+	if err := json.Unmarshal(fm.Payload, &snap); err != nil {
+		return
+	}
+
+	roomsMutex.Lock()
+	room, exists := rooms[roomID]
+	roomsMutex.Unlock()
+	if !exists {
+		return
+	}
+
+	room.Mutex.Lock()
+	defer room.Mutex.Unlock()
+
+	if room.Player == nil {
+		room.Player = &PlayerState{}
+	}
+	room.Player.URL = snap.URL
+	room.Player.Position = snap.Position
+	room.Player.PlaybackRate = snap.PlaybackRate
+	room.Player.IsPaused = snap.IsPaused
+	room.Player.LastUpdatedBy = snap.LastUpdatedBy
+	room.Player.LastUpdatedAt = snap.LastUpdatedAt
+
+	deliverLocalAndRecord(room, "player.sync", playerSnapshot(room.Player), fm.AuthorUserID, fm.AuthorDisplayName)
+}
+
+// startFederation registers the inbound acceptor endpoint, which refuses
+// peers unless PROXY_SECRET is set. It dials every configured peer, and
+// sends "bye" to all peers on SIGINT/SIGTERM, only when PROXY_SECRET and at
+// least one peer address are configured.
+func startFederation(mux *http.ServeMux, peerAddrs []string) {
+	mux.HandleFunc("/federation/ws", handleFederationInbound)
+
+	if len(proxySecret) == 0 || len(peerAddrs) == 0 {
+		return
+	}
+
+	for _, addr := range peerAddrs {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		go dialPeer(addr)
+	}
+
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		<-sigCh
+		for _, peer := range peerSnapshot() {
+			peer.closeWithBye()
+		}
+		os.Exit(0)
+	}()
+}
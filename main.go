@@ -5,6 +5,8 @@ import (
 	"compress/gzip"
 	crand "crypto/rand"
 	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"html/template"
 	"log"
@@ -19,12 +21,17 @@ import (
 	"github.com/andybalholm/brotli"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/securecookie"
-	"golang.org/x/net/websocket"
+	"github.com/gorilla/websocket"
 )
 
 var scookie *securecookie.SecureCookie
 var jwtSecret []byte
 
+// backendSecret authenticates the backend integration API
+// (see backendAuth). It is optional: when unset, those endpoints are
+// disabled rather than accepting unsigned requests.
+var backendSecret []byte
+
 var roomsMutex sync.Mutex
 var rooms = make(map[string]*Room)
 
@@ -32,14 +39,219 @@ var indexTemplate = template.Must(template.ParseFiles("templates/index.html"))
 var chatTemplate = template.Must(template.ParseFiles("templates/chat.html"))
 
 type Room struct {
+	ID      string
 	Clients map[*Client]bool
 	Mutex   sync.Mutex
+
+	// History is a bounded ring buffer of the last historyLimit messages,
+	// replayed to newly connected clients so refreshing the page doesn't
+	// lose context. It mirrors what's been handed to roomStore.
+	History       []StoredMessage
+	nextMessageID uint64
+
+	// Player holds the synchronized watch-party state, or nil if no video
+	// has been loaded into the room yet.
+	Player *PlayerState
+
+	// HostUserID is the UserID of the client currently allowed to control
+	// playback when EveryoneCanControl is false. It starts as the first
+	// joiner and is transferred to another client in the room if the host
+	// disconnects.
+	HostUserID string
+
+	// EveryoneCanControl, when true, lets any client issue player.* events
+	// instead of restricting control to HostUserID. Toggled by the host via
+	// a player.set_control_mode message (see handleSetControlMode).
+	EveryoneCanControl bool
+
+	// BulletLimiters holds a per-user token bucket for the bullet (danmaku)
+	// overlay channel, keyed by UserID.
+	BulletLimiters map[string]*bulletLimiter
+
+	// nextBulletID assigns a monotonic, server-side ID to each bullet sent
+	// in the room.
+	nextBulletID uint64
+
+	// Backend holds the constraints applied when this room was provisioned
+	// through the HMAC-authenticated backend API. It is nil for rooms
+	// created organically when a client connects (handleWebSocket).
+	Backend *BackendOptions
+}
+
+// BackendOptions constrains a room provisioned via POST /api/backend/rooms.
+type BackendOptions struct {
+	MaxClients     int
+	ExpiresAt      time.Time
+	AllowedOrigins []string
+
+	// JoinTokens maps a redeemable token to the UserID it grants, so a
+	// backend-gated room can be reached without relying on a visitor's
+	// self-assigned cookie ID (which the backend has no way to predict).
+	// servePage redeems ?token=... into the UserID of the auth_token JWT;
+	// backendOptionsAllow then checks the resulting UserID against this map.
+	JoinTokens map[string]string
+}
+
+const (
+	maxBulletsPerWindow = 3
+	bulletRateWindow    = 5 * time.Second
+)
+
+// bulletLimiter is a simple token bucket enforcing maxBulletsPerWindow
+// bullets per bulletRateWindow for a single user.
+type bulletLimiter struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+// allow reports whether a bullet may be sent now, consuming a token if so.
+func (l *bulletLimiter) allow(now time.Time) bool {
+	refillRate := float64(maxBulletsPerWindow) / bulletRateWindow.Seconds()
+	l.tokens += now.Sub(l.lastRefill).Seconds() * refillRate
+	if l.tokens > maxBulletsPerWindow {
+		l.tokens = maxBulletsPerWindow
+	}
+	l.lastRefill = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// PlayerState tracks the synchronized playback position of a room's video,
+// modeled after the watch-party state kept by SyncTV-style servers.
+type PlayerState struct {
+	URL           string
+	Position      float64
+	PlaybackRate  float64
+	PausedAt      time.Time
+	IsPaused      bool
+	LastUpdatedBy string
+	LastUpdatedAt time.Time
+}
+
+// projectedPosition returns the playback position extrapolated to now,
+// accounting for elapsed time and PlaybackRate when the player isn't paused.
+func (p *PlayerState) projectedPosition(now time.Time) float64 {
+	if p.IsPaused {
+		return p.Position
+	}
+	return p.Position + now.Sub(p.LastUpdatedAt).Seconds()*p.PlaybackRate
 }
 
 type Client struct {
 	Conn        *websocket.Conn
 	UserID      string
 	DisplayName string
+
+	// Send is the client's outbound buffered channel. All writes to Conn
+	// happen on its single writePump goroutine; other goroutines must
+	// deliver messages through this channel instead of writing directly.
+	Send chan []byte
+
+	// closeSendOnce guards Send against being closed twice: readPump's
+	// cleanup and deliverLocalAndRecord's slow-client eviction can both
+	// decide to close it for the same client.
+	closeSendOnce sync.Once
+}
+
+// closeSend closes c.Send at most once, however many call sites decide the
+// client needs to be dropped.
+func (c *Client) closeSend() {
+	c.closeSendOnce.Do(func() {
+		close(c.Send)
+	})
+}
+
+// wsEnvelope is the JSON message envelope exchanged over the websocket,
+// replacing the original raw-string chat protocol.
+type wsEnvelope struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// outEnvelope is the server->client counterpart of wsEnvelope; Payload is
+// marshaled directly rather than kept raw.
+type outEnvelope struct {
+	Type    string      `json:"type"`
+	Payload interface{} `json:"payload"`
+}
+
+type chatPayload struct {
+	Text string `json:"text"`
+}
+
+type playerLoadPayload struct {
+	URL string `json:"url"`
+}
+
+type playerSeekPayload struct {
+	Position float64 `json:"position"`
+}
+
+type playerRatePayload struct {
+	Rate float64 `json:"rate"`
+}
+
+// bulletInPayload is the client-supplied shape of a bullet (danmaku) message;
+// ID and ServerTS are assigned by the server.
+type bulletInPayload struct {
+	Text     string `json:"text"`
+	Color    string `json:"color"`
+	Position string `json:"position"`
+	Size     int    `json:"size"`
+}
+
+// bulletPayload is the broadcast shape of a bullet message.
+type bulletPayload struct {
+	ID        uint64 `json:"id"`
+	Text      string `json:"text"`
+	Color     string `json:"color,omitempty"`
+	Position  string `json:"position"`
+	Size      int    `json:"size,omitempty"`
+	DisplayBy string `json:"displayBy"`
+	ServerTS  int64  `json:"serverTs"`
+}
+
+// setControlModePayload toggles Room.EveryoneCanControl; only the host may
+// send it.
+type setControlModePayload struct {
+	EveryoneCanControl bool `json:"everyoneCanControl"`
+}
+
+type playerSyncPayload struct {
+	URL           string    `json:"url"`
+	Position      float64   `json:"position"`
+	PlaybackRate  float64   `json:"playbackRate"`
+	IsPaused      bool      `json:"isPaused"`
+	LastUpdatedBy string    `json:"lastUpdatedBy"`
+	LastUpdatedAt time.Time `json:"lastUpdatedAt"`
+}
+
+// playerSnapshot builds the player.sync payload for p, projecting Position
+// to the current time so a newly joined or reconciling client can seek to
+// the right spot immediately.
+func playerSnapshot(p *PlayerState) playerSyncPayload {
+	now := time.Now()
+	return playerSyncPayload{
+		URL:           p.URL,
+		Position:      p.projectedPosition(now),
+		PlaybackRate:  p.PlaybackRate,
+		IsPaused:      p.IsPaused,
+		LastUpdatedBy: p.LastUpdatedBy,
+		LastUpdatedAt: p.LastUpdatedAt,
+	}
+}
+
+// roomStatePayload tells a single client who's host and whether playback
+// control is open to everyone. YourUserID lets the client recognize itself
+// without needing to decode its own JWT client-side.
+type roomStatePayload struct {
+	HostUserID         string `json:"hostUserId"`
+	EveryoneCanControl bool   `json:"everyoneCanControl"`
+	YourUserID         string `json:"yourUserId"`
 }
 
 type ChatPageData struct {
@@ -140,6 +352,16 @@ func init() {
 
 	scookie = securecookie.New([]byte(hashKeyStr), []byte(blockKeyStr))
 	jwtSecret = []byte(jwtSecretStr)
+
+	if backendSecretStr := os.Getenv("BACKEND_SECRET"); backendSecretStr != "" {
+		backendSecret = []byte(backendSecretStr)
+	}
+
+	if proxySecretStr := os.Getenv("PROXY_SECRET"); proxySecretStr != "" {
+		proxySecret = []byte(proxySecretStr)
+	}
+
+	initRoomStore()
 }
 
 func generateID() string {
@@ -194,9 +416,29 @@ func servePage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	roomsMutex.Lock()
+	room := rooms[roomID]
+	roomsMutex.Unlock()
+
+	var backend *BackendOptions
+	if room != nil {
+		room.Mutex.Lock()
+		backend = room.Backend
+		room.Mutex.Unlock()
+	}
+
 	var userID string
-	userIDCookie, err := r.Cookie("room_user_id_" + roomID)
-	if err == nil {
+	if backend != nil && len(backend.JoinTokens) > 0 {
+		// This room only admits visitors redeeming a token the backend
+		// handed out in advance; a self-assigned cookie ID can never be on
+		// the list, so don't fall back to one.
+		mappedID, ok := backend.JoinTokens[r.URL.Query().Get("token")]
+		if !ok {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		userID = mappedID
+	} else if userIDCookie, err := r.Cookie("room_user_id_" + roomID); err == nil {
 		userID = userIDCookie.Value
 	}
 
@@ -294,10 +536,34 @@ body {
 	}
 }
 
-func handleWebSocket(ws *websocket.Conn) {
-	cookie, err := ws.Request().Cookie("auth_token")
+// upgrader negotiates RFC 7692 permessage-deflate compression, which mostly
+// benefits the larger chat-history and player.sync payloads.
+var upgrader = websocket.Upgrader{
+	EnableCompression: true,
+	ReadBufferSize:    4096,
+	WriteBufferSize:   4096,
+	// Cross-origin embedding is handled explicitly via BackendOptions.AllowedOrigins
+	// after the JWT is parsed, rather than gorilla's default same-origin check.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+const (
+	writeWait  = 10 * time.Second
+	pongWait   = 70 * time.Second
+	pingPeriod = (pongWait * 9) / 10
+
+	// sendBufferSize bounds how far a client can fall behind before it's
+	// dropped rather than allowed to block broadcasts to the rest of the
+	// room.
+	sendBufferSize = 32
+)
+
+// serveWS authenticates the auth_token cookie before upgrading to a
+// websocket connection, then hands off to handleWebSocket.
+func serveWS(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie("auth_token")
 	if err != nil {
-		ws.Close()
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
@@ -307,101 +573,505 @@ func handleWebSocket(ws *websocket.Conn) {
 		}
 		return jwtSecret, nil
 	})
-
 	if err != nil || !token.Valid {
-		ws.Close()
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
 	claims, ok := token.Claims.(*CustomClaims)
 	if !ok {
-		ws.Close()
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Error upgrading websocket: %v", err)
 		return
 	}
 
+	handleWebSocket(conn, claims, r)
+}
+
+func handleWebSocket(conn *websocket.Conn, claims *CustomClaims, r *http.Request) {
 	roomID := claims.RoomID
 	userID := claims.UserID
 	displayName := claims.DisplayName
 
 	client := &Client{
-		Conn:        ws,
+		Conn:        conn,
 		UserID:      userID,
 		DisplayName: displayName,
+		Send:        make(chan []byte, sendBufferSize),
 	}
 
 	roomsMutex.Lock()
 	room, exists := rooms[roomID]
-	if !exists {
-		room = &Room{Clients: make(map[*Client]bool)}
+	isNewRoom := !exists
+	if isNewRoom {
+		history := roomStore.Load(roomID, historyLimit)
+		room = &Room{
+			ID:             roomID,
+			Clients:        make(map[*Client]bool),
+			BulletLimiters: make(map[string]*bulletLimiter),
+			History:        history,
+		}
+		if len(history) > 0 {
+			room.nextMessageID = history[len(history)-1].ID
+		}
 		rooms[roomID] = room
 	}
-	room.Clients[client] = true
 	roomsMutex.Unlock()
 
-	defer func() {
-		room.Mutex.Lock()
-		delete(room.Clients, client)
-		isEmpty := len(room.Clients) == 0
-		room.Mutex.Unlock()
+	room.Mutex.Lock()
+	backend := room.Backend
+	room.Mutex.Unlock()
 
-		if isEmpty {
-			roomsMutex.Lock()
-			delete(rooms, roomID)
-			roomsMutex.Unlock()
-		}
-		ws.Close()
-	}()
+	if backend != nil && !backendOptionsAllow(room, backend, userID, r.Header.Get("Origin")) {
+		conn.Close()
+		return
+	}
 
-	pingTicker := time.NewTicker(60 * time.Second)
-	defer pingTicker.Stop()
-	go func() {
-		for range pingTicker.C {
-			if err := websocket.Message.Send(ws, ""); err != nil {
-				ws.Close()
-				return
-			}
+	room.Mutex.Lock()
+	firstJoin := len(room.Clients) == 0
+	room.Clients[client] = true
+	// The first client to actually join becomes host, whether or not the
+	// Room itself already existed (e.g. provisioned in advance via the
+	// backend API). generateID never returns "", so an empty HostUserID
+	// reliably means no one has claimed it yet.
+	if room.HostUserID == "" {
+		room.HostUserID = userID
+	}
+	broadcastRoomStateLocked(room)
+	var playerSync *playerSyncPayload
+	if room.Player != nil {
+		snap := playerSnapshot(room.Player)
+		playerSync = &snap
+	}
+	history := make([]StoredMessage, len(room.History))
+	copy(history, room.History)
+	room.Mutex.Unlock()
+
+	if firstJoin {
+		announceRoomInterest(roomID, true)
+	}
+
+	if len(history) > 0 {
+		deliver(client, "history.replay", historyReplayPayload{Messages: history})
+	}
+	if playerSync != nil {
+		deliver(client, "player.sync", playerSync)
+	}
+
+	go client.writePump()
+	client.readPump(room, roomID)
+}
+
+// historyReplayPayload is sent to a newly joined client so it can render
+// recent context immediately, without waiting for new activity.
+type historyReplayPayload struct {
+	Messages []StoredMessage `json:"messages"`
+}
+
+// deliver marshals an envelope and pushes it to a single client's send
+// buffer, dropping it silently if the buffer is full (the client is about
+// to be reconciled or disconnected by its own writePump/readPump anyway).
+func deliver(client *Client, msgType string, payload interface{}) {
+	data, err := json.Marshal(outEnvelope{Type: msgType, Payload: payload})
+	if err != nil {
+		log.Printf("Error marshaling %s envelope: %v", msgType, err)
+		return
+	}
+	select {
+	case client.Send <- data:
+	default:
+	}
+}
+
+// leaveRoom removes client from room, transferring host status if needed,
+// and drops the room entirely once it's empty.
+func leaveRoom(room *Room, roomID string, client *Client) {
+	room.Mutex.Lock()
+	delete(room.Clients, client)
+	isEmpty := len(room.Clients) == 0
+	if !isEmpty && room.HostUserID == client.UserID {
+		for c := range room.Clients {
+			room.HostUserID = c.UserID
+			break
 		}
+		broadcastRoomStateLocked(room)
+	}
+	room.Mutex.Unlock()
+
+	if isEmpty {
+		roomsMutex.Lock()
+		delete(rooms, roomID)
+		roomsMutex.Unlock()
+		announceRoomInterest(roomID, false)
+	}
+}
+
+// readPump is the only goroutine reading from client.Conn, as required by
+// gorilla/websocket. It refreshes the read deadline on every pong so idle
+// peers are disconnected cleanly.
+func (c *Client) readPump(room *Room, roomID string) {
+	defer func() {
+		leaveRoom(room, roomID, c)
+		c.closeSend()
 	}()
 
+	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.Conn.SetPongHandler(func(string) error {
+		c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
 	for {
-		var msg string
-		err := websocket.Message.Receive(ws, &msg)
+		_, raw, err := c.Conn.ReadMessage()
 		if err != nil {
 			break
 		}
 
-		msg = strings.TrimSpace(msg)
+		msg := strings.TrimSpace(string(raw))
 		if len(msg) == 0 || msg == "CHECKMARK_CLICKED" {
 			continue
 		}
 
-		if len(msg) > maxMessageLength {
-			errorMsg := "System: Message exceeds 160 character limit and was not sent."
-			websocket.Message.Send(client.Conn, errorMsg)
-			continue
+		env := parseEnvelope(msg)
+
+		switch env.Type {
+		case "chat":
+			handleChatMessage(room, c, env.Payload)
+		case "bullet":
+			handleBulletMessage(room, c, env.Payload)
+		case "player.load", "player.play", "player.pause", "player.seek", "player.rate":
+			handlePlayerEvent(room, c, env.Type, env.Payload)
+		case "player.set_control_mode":
+			handleSetControlMode(room, c, env.Payload)
+		default:
+			// Unknown message type; ignore rather than disconnecting the client.
 		}
+	}
+}
 
-		formattedMsg := client.DisplayName + ": " + msg
+// writePump is the only goroutine writing to client.Conn, as gorilla/websocket
+// requires. It multiplexes outbound envelopes from c.Send with periodic
+// ping frames, and tears the connection down if either stalls past writeWait.
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.Conn.Close()
+	}()
 
-		room.Mutex.Lock()
-		for clientConn := range room.Clients {
-			if err := websocket.Message.Send(clientConn.Conn, formattedMsg); err != nil {
-				log.Printf("Error sending message to client %s: %v", clientConn.DisplayName, err)
+	for {
+		select {
+		case msg, ok := <-c.Send:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.Conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
 			}
 		}
-		room.Mutex.Unlock()
 	}
 }
 
+// parseEnvelope decodes a raw websocket frame into a wsEnvelope. Frames that
+// aren't a valid envelope are treated as the legacy raw-string chat protocol
+// and wrapped as a chat message for backward compatibility.
+func parseEnvelope(raw string) wsEnvelope {
+	var env wsEnvelope
+	if err := json.Unmarshal([]byte(raw), &env); err != nil || env.Type == "" {
+		payload, _ := json.Marshal(chatPayload{Text: raw})
+		return wsEnvelope{Type: "chat", Payload: payload}
+	}
+	return env
+}
+
+func handleChatMessage(room *Room, client *Client, payload json.RawMessage) {
+	var p chatPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return
+	}
+
+	text := strings.TrimSpace(p.Text)
+	if text == "" {
+		return
+	}
+
+	if len(text) > maxMessageLength {
+		sendSystemMessage(client, "Message exceeds 160 character limit and was not sent.")
+		return
+	}
+
+	broadcastEnvelope(room, "chat", chatPayload{Text: client.DisplayName + ": " + text}, client.UserID, client.DisplayName)
+}
+
+var validBulletPositions = map[string]bool{"top": true, "scroll": true, "bottom": true}
+
+// handleBulletMessage validates and rate-limits a bullet (danmaku) message,
+// then broadcasts it with a server-assigned ID and timestamp. Bullets render
+// as an overlay over the player rather than in the message list.
+func handleBulletMessage(room *Room, client *Client, payload json.RawMessage) {
+	var p bulletInPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return
+	}
+
+	text := strings.TrimSpace(p.Text)
+	if text == "" {
+		return
+	}
+	if len(text) > maxMessageLength {
+		sendSystemMessage(client, "Message exceeds 160 character limit and was not sent.")
+		return
+	}
+
+	position := p.Position
+	if !validBulletPositions[position] {
+		position = "scroll"
+	}
+
+	room.Mutex.Lock()
+	defer room.Mutex.Unlock()
+
+	limiter, ok := room.BulletLimiters[client.UserID]
+	if !ok {
+		limiter = &bulletLimiter{tokens: maxBulletsPerWindow, lastRefill: time.Now()}
+		room.BulletLimiters[client.UserID] = limiter
+	}
+	if !limiter.allow(time.Now()) {
+		return
+	}
+
+	room.nextBulletID++
+	bullet := bulletPayload{
+		ID:        room.nextBulletID,
+		Text:      text,
+		Color:     p.Color,
+		Position:  position,
+		Size:      p.Size,
+		DisplayBy: client.DisplayName,
+		ServerTS:  time.Now().UnixMilli(),
+	}
+
+	broadcastLocked(room, "bullet", bullet, client.UserID, client.DisplayName)
+}
+
+// handlePlayerEvent applies a player.* event to the room's PlayerState under
+// Room.Mutex and broadcasts the resulting player.sync snapshot. Control is
+// restricted to the room's host unless EveryoneCanControl is set.
+func handlePlayerEvent(room *Room, client *Client, msgType string, payload json.RawMessage) {
+	room.Mutex.Lock()
+	defer room.Mutex.Unlock()
+
+	if room.HostUserID != client.UserID && !room.EveryoneCanControl {
+		return
+	}
+
+	if room.Player == nil {
+		room.Player = &PlayerState{PlaybackRate: 1}
+	}
+	p := room.Player
+
+	switch msgType {
+	case "player.load":
+		var lp playerLoadPayload
+		if err := json.Unmarshal(payload, &lp); err != nil || lp.URL == "" {
+			return
+		}
+		p.URL = lp.URL
+		p.Position = 0
+		p.IsPaused = true
+
+	case "player.play":
+		p.IsPaused = false
+
+	case "player.pause":
+		p.Position = p.projectedPosition(time.Now())
+		p.IsPaused = true
+		p.PausedAt = time.Now()
+
+	case "player.seek":
+		var sp playerSeekPayload
+		if err := json.Unmarshal(payload, &sp); err != nil {
+			return
+		}
+		p.Position = sp.Position
+
+	case "player.rate":
+		var rp playerRatePayload
+		if err := json.Unmarshal(payload, &rp); err != nil || rp.Rate <= 0 {
+			return
+		}
+		p.Position = p.projectedPosition(time.Now())
+		p.PlaybackRate = rp.Rate
+	}
+
+	p.LastUpdatedBy = client.DisplayName
+	p.LastUpdatedAt = time.Now()
+
+	broadcastLocked(room, "player.sync", playerSnapshot(p), client.UserID, client.DisplayName)
+}
+
+// handleSetControlMode lets the host flip Room.EveryoneCanControl, opening
+// up (or closing back off) player.* control to every client in the room.
+func handleSetControlMode(room *Room, client *Client, payload json.RawMessage) {
+	room.Mutex.Lock()
+	defer room.Mutex.Unlock()
+
+	if room.HostUserID != client.UserID {
+		return
+	}
+
+	var p setControlModePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return
+	}
+
+	room.EveryoneCanControl = p.EveryoneCanControl
+	broadcastRoomStateLocked(room)
+}
+
+// broadcastRoomStateLocked sends each client in room its own room.state
+// envelope so it can resolve its current host/control-mode status. Callers
+// must already hold room.Mutex.
+func broadcastRoomStateLocked(room *Room) {
+	for c := range room.Clients {
+		deliver(c, "room.state", roomStatePayload{
+			HostUserID:         room.HostUserID,
+			EveryoneCanControl: room.EveryoneCanControl,
+			YourUserID:         c.UserID,
+		})
+	}
+}
+
+// sendSystemMessage delivers a server-authored notice to a single client's
+// send buffer, dropping it rather than blocking if the client is backed up.
+func sendSystemMessage(client *Client, text string) {
+	data, err := json.Marshal(outEnvelope{Type: "system", Payload: chatPayload{Text: text}})
+	if err != nil {
+		return
+	}
+	select {
+	case client.Send <- data:
+	default:
+		log.Printf("Dropping system message to slow client %s", client.DisplayName)
+	}
+}
+
+// broadcastLocked sends an envelope to every client in room and records it
+// in the room's history. Callers must already hold room.Mutex. A client
+// whose send buffer is full is dropped from the room rather than allowed to
+// block the broadcast.
+func broadcastLocked(room *Room, msgType string, payload interface{}, authorUserID, authorDisplayName string) {
+	deliverLocalAndRecord(room, msgType, payload, authorUserID, authorDisplayName)
+	forwardToPeers(room.ID, msgType, payload, authorUserID, authorDisplayName)
+}
+
+// deliverLocalAndRecord sends an envelope to every client in room and
+// records it in the room's history, but does not forward it to federation
+// peers. It's the shared core broadcastLocked uses for locally originated
+// events and applyFederatedMessage/applyFederatedPlayer use for events
+// replayed in from a peer, which must not be forwarded again. Callers must
+// already hold room.Mutex.
+func deliverLocalAndRecord(room *Room, msgType string, payload interface{}, authorUserID, authorDisplayName string) {
+	data, err := json.Marshal(outEnvelope{Type: msgType, Payload: payload})
+	if err != nil {
+		log.Printf("Error marshaling %s envelope: %v", msgType, err)
+		return
+	}
+	for c := range room.Clients {
+		select {
+		case c.Send <- data:
+		default:
+			log.Printf("Dropping slow client %s: send buffer full", c.DisplayName)
+			c.closeSend()
+			delete(room.Clients, c)
+		}
+	}
+
+	recordHistory(room, msgType, payload, authorUserID, authorDisplayName)
+}
+
+// broadcastEnvelope acquires room.Mutex and sends an envelope to every
+// client in room.
+func broadcastEnvelope(room *Room, msgType string, payload interface{}, authorUserID, authorDisplayName string) {
+	room.Mutex.Lock()
+	defer room.Mutex.Unlock()
+	broadcastLocked(room, msgType, payload, authorUserID, authorDisplayName)
+}
+
+// historyText extracts the display text worth keeping in message history
+// for payload, or "" for message types with nothing worth replaying as text.
+func historyText(payload interface{}) string {
+	switch p := payload.(type) {
+	case chatPayload:
+		return p.Text
+	case bulletPayload:
+		return p.Text
+	case playerSyncPayload:
+		return p.URL
+	default:
+		return ""
+	}
+}
+
+// recordHistory appends msg to room.History (trimmed to historyLimit) and
+// to roomStore, so late joiners and, with a persistent store, restarts can
+// replay recent context. Callers must already hold room.Mutex.
+func recordHistory(room *Room, msgType string, payload interface{}, authorUserID, authorDisplayName string) {
+	room.nextMessageID++
+	msg := StoredMessage{
+		ID:          room.nextMessageID,
+		UserID:      authorUserID,
+		DisplayName: authorDisplayName,
+		Text:        historyText(payload),
+		Type:        msgType,
+		ServerTS:    time.Now(),
+	}
+
+	room.History = append(room.History, msg)
+	if len(room.History) > historyLimit {
+		room.History = room.History[len(room.History)-historyLimit:]
+	}
+
+	roomStore.Append(room.ID, msg)
+}
+
 func main() {
+	proxyPeersFlag := flag.String("proxy-peers", "", "Comma-separated list of cheetah.ninja peer addresses to federate rooms with")
+	flag.Parse()
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
 
+	peerList := *proxyPeersFlag
+	if peerList == "" {
+		peerList = os.Getenv("PROXY_PEERS")
+	}
+	var peerAddrs []string
+	if peerList != "" {
+		peerAddrs = strings.Split(peerList, ",")
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", servePage)
-	mux.Handle("/ws", websocket.Handler(handleWebSocket))
+	mux.HandleFunc("/ws", serveWS)
+	mux.HandleFunc("/api/backend/rooms", backendAuth(handleBackendCreateRoom))
+	mux.HandleFunc("/api/backend/rooms/", backendAuth(handleBackendRoomMessage))
+	startFederation(mux, peerAddrs)
 
 	finalHandler := compressionHandler(mux)
 
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// historyLimit bounds how many messages Room.History and RoomStore keep per
+// room.
+const historyLimit = 200
+
+// StoredMessage is the persisted shape of a single room message, covering
+// chat, bullet, system and player.* events alike.
+type StoredMessage struct {
+	ID          uint64    `json:"id"`
+	UserID      string    `json:"userId"`
+	DisplayName string    `json:"displayName"`
+	Text        string    `json:"text"`
+	Type        string    `json:"msgType"`
+	ServerTS    time.Time `json:"serverTs"`
+}
+
+// RoomStore persists room history behind a pluggable backend, so rooms can
+// optionally survive process restarts.
+type RoomStore interface {
+	Append(roomID string, msg StoredMessage)
+	Load(roomID string, limit int) []StoredMessage
+}
+
+// roomStore is the process-wide history backend, selected in initRoomStore
+// based on the ROOM_STORE_DRIVER environment variable.
+var roomStore RoomStore
+
+// initRoomStore picks the RoomStore implementation. The default is an
+// in-memory store; setting ROOM_STORE_DRIVER=bolt persists history to a
+// BoltDB file at ROOM_STORE_PATH (default "rooms.db") so it survives
+// restarts.
+func initRoomStore() {
+	switch os.Getenv("ROOM_STORE_DRIVER") {
+	case "bolt":
+		path := os.Getenv("ROOM_STORE_PATH")
+		if path == "" {
+			path = "rooms.db"
+		}
+		store, err := newBoltRoomStore(path)
+		if err != nil {
+			log.Fatalf("FATAL: could not open bolt room store at %s: %v", path, err)
+		}
+		roomStore = store
+	default:
+		roomStore = newMemoryRoomStore()
+	}
+}
+
+// memoryRoomStore is the default RoomStore: history lives only as long as
+// the process does.
+type memoryRoomStore struct {
+	mu   sync.Mutex
+	msgs map[string][]StoredMessage
+}
+
+func newMemoryRoomStore() *memoryRoomStore {
+	return &memoryRoomStore{msgs: make(map[string][]StoredMessage)}
+}
+
+func (s *memoryRoomStore) Append(roomID string, msg StoredMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	history := append(s.msgs[roomID], msg)
+	if len(history) > historyLimit {
+		history = history[len(history)-historyLimit:]
+	}
+	s.msgs[roomID] = history
+}
+
+func (s *memoryRoomStore) Load(roomID string, limit int) []StoredMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	history := s.msgs[roomID]
+	if len(history) > limit {
+		history = history[len(history)-limit:]
+	}
+	out := make([]StoredMessage, len(history))
+	copy(out, history)
+	return out
+}
+
+// boltRoomStore persists history to a BoltDB file, one bucket per room, keyed
+// by the message's big-endian-encoded ID so iteration order matches send order.
+type boltRoomStore struct {
+	db *bolt.DB
+}
+
+func newBoltRoomStore(path string) (*boltRoomStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &boltRoomStore{db: db}, nil
+}
+
+func (s *boltRoomStore) Append(roomID string, msg StoredMessage) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(roomID))
+		if err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put(messageKey(msg.ID), data); err != nil {
+			return err
+		}
+
+		return trimBucket(bucket, historyLimit)
+	})
+	if err != nil {
+		log.Printf("Error appending message to bolt room store: %v", err)
+	}
+}
+
+func (s *boltRoomStore) Load(roomID string, limit int) []StoredMessage {
+	var out []StoredMessage
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(roomID))
+		if bucket == nil {
+			return nil
+		}
+
+		c := bucket.Cursor()
+		for k, v := c.Last(); k != nil && len(out) < limit; k, v = c.Prev() {
+			var msg StoredMessage
+			if err := json.Unmarshal(v, &msg); err != nil {
+				continue
+			}
+			out = append(out, msg)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error loading messages from bolt room store: %v", err)
+		return nil
+	}
+
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
+
+// trimBucket drops the oldest entries in bucket until at most limit remain.
+func trimBucket(bucket *bolt.Bucket, limit int) error {
+	count := bucket.Stats().KeyN
+	if count <= limit {
+		return nil
+	}
+
+	c := bucket.Cursor()
+	for k, _ := c.First(); k != nil && count > limit; k, _ = c.Next() {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+		count--
+	}
+	return nil
+}
+
+func messageKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}